@@ -15,6 +15,9 @@
 package llvm
 
 import (
+	"os"
+	"path/filepath"
+
 	"android/soong/android"
 	"android/soong/cc"
 
@@ -22,13 +25,153 @@ import (
 	"github.com/google/blueprint/proptools"
 )
 
+// pgoProfileDir is where profile_file properties are resolved against
+// unless PGO_PROFILE_DIR overrides it.
+const pgoProfileDir = "toolchain/pgo-profiles"
+
+// llvmConfigNamespace is the PRODUCT_SOONG_CONFIG_NAMESPACES namespace
+// products use to drive LLVM's build shape without environment variables.
+const llvmConfigNamespace = "llvm"
+
+// llvmSoongConfig returns the `llvm` soong config namespace, populated
+// from PRODUCT_SOONG_CONFIG_VARIABLES by the product config.
+func llvmSoongConfig(ctx android.BaseContext) android.VendorConfig {
+	return ctx.AConfig().VendorConfig(llvmConfigNamespace)
+}
+
+// llvmConfigBool reads a bool-typed variable out of the `llvm` namespace,
+// falling back to def when the product config never set it. Plain
+// VendorConfig.Bool has no notion of "unset", so this is needed for
+// variables (like enable_ndebug below) whose replaced env var defaulted
+// to the opposite polarity.
+func llvmConfigBool(ctx android.BaseContext, name string, def bool) bool {
+	switch llvmSoongConfig(ctx).String(name) {
+	case "":
+		return def
+	case "true", "1":
+		return true
+	default:
+		return false
+	}
+}
+
+// The `llvm` soong config namespace's typed variables, read via
+// llvmSoongConfig/llvmConfigBool throughout this file. Unlike the
+// FORCE_BUILD_LLVM_*/DISABLE_LLVM_* environment variables they replace,
+// values set here come from PRODUCT_SOONG_CONFIG_VARIABLES and so are
+// reproducible across builds instead of busting the build cache.
+//
+//	build_llvm_components  bool   build the LLVM host components (was FORCE_BUILD_LLVM_COMPONENTS)
+//	disable_device_builds  bool   disable Android target variants (was DISABLE_LLVM_DEVICE_BUILDS)
+//	debug                  bool   build host variants at -O0 -g (was FORCE_BUILD_LLVM_DEBUG)
+//	enable_ndebug          bool   keep NDEBUG defined, default true (was !FORCE_BUILD_LLVM_DISABLE_NDEBUG)
+//	lto_mode               string "none" (default), "thin", or "full"
+//
+// llvm_release, llvm_thin_lto, and llvm_hwasan_host (registered in init
+// below) are named variants downstream Android.bp files can add to
+// `defaults` for the same product-independent build shapes, without
+// setting environment variables or PRODUCT_SOONG_CONFIG_VARIABLES.
+
+// llvmRelease is the llvm_release named variant: an optimized,
+// assertions-off build shape, for products that don't want to set
+// enable_ndebug themselves.
+func llvmRelease(ctx android.LoadHookContext) {
+	type props struct {
+		Cflags []string
+	}
+	p := &props{}
+	p.Cflags = []string{"-O2", "-DNDEBUG"}
+	ctx.AppendProperties(p)
+}
+
+// llvmThinLto is the llvm_thin_lto named variant, equivalent to setting
+// `lto: { thin: true }` directly but reusable across Android.bp files.
+func llvmThinLto(ctx android.LoadHookContext) {
+	lto := &ltoProperties{}
+	lto.Lto.Thin = proptools.BoolPtr(true)
+
+	type props struct {
+		Cflags []string
+		Target struct {
+			Linux   struct{ Ldflags []string }
+			Darwin  struct{ Ldflags []string }
+			Android struct{ Ldflags []string }
+		}
+	}
+	p := &props{}
+	p.Cflags = ltoCflags(ctx, lto)
+	p.Target.Linux.Ldflags = ltoLdflags(ctx, lto, false)
+	p.Target.Darwin.Ldflags = ltoLdflags(ctx, lto, true)
+	p.Target.Android.Ldflags = ltoLdflags(ctx, lto, false)
+	ctx.AppendProperties(p)
+}
+
+// llvmHwasanHost is the llvm_hwasan_host named variant: HWASan on host
+// Linux/Darwin variants only, for catching host-tool memory bugs without
+// touching device builds.
+func llvmHwasanHost(ctx android.LoadHookContext) {
+	type props struct {
+		Target struct {
+			Linux struct {
+				Cflags  []string
+				Ldflags []string
+			}
+			Darwin struct {
+				Cflags  []string
+				Ldflags []string
+			}
+		}
+	}
+	p := &props{}
+	flags := []string{"-fsanitize=hwaddress"}
+	p.Target.Linux.Cflags = flags
+	p.Target.Linux.Ldflags = flags
+	p.Target.Darwin.Cflags = flags
+	p.Target.Darwin.Ldflags = flags
+	ctx.AppendProperties(p)
+}
+
+func llvmReleaseFactory() (blueprint.Module, []interface{}) {
+	module, props := cc.DefaultsFactory()
+	android.AddLoadHook(module, llvmRelease)
+	return module, props
+}
+
+func llvmThinLtoFactory() (blueprint.Module, []interface{}) {
+	module, props := cc.DefaultsFactory()
+	android.AddLoadHook(module, llvmThinLto)
+	return module, props
+}
+
+func llvmHwasanHostFactory() (blueprint.Module, []interface{}) {
+	module, props := cc.DefaultsFactory()
+	android.AddLoadHook(module, llvmHwasanHost)
+	return module, props
+}
+
+func ltoModeFlags(ctx android.BaseContext) []string {
+	switch mode := llvmSoongConfig(ctx).String("lto_mode"); mode {
+	case "", "none":
+		return nil
+	case "thin":
+		return []string{"-flto=thin"}
+	case "full":
+		return []string{"-flto"}
+	default:
+		ctx.ModuleErrorf("unknown llvm.lto_mode %q: must be \"none\", \"thin\", or \"full\"", mode)
+		return nil
+	}
+}
+
 func globalFlags(ctx android.BaseContext) []string {
 	var cflags []string
 
-	if ctx.AConfig().IsEnvTrue("FORCE_BUILD_LLVM_DISABLE_NDEBUG") {
+	if !llvmConfigBool(ctx, "enable_ndebug", true) {
 		cflags = append(cflags, "-D_DEBUG", "-UNDEBUG")
 	}
 
+	cflags = append(cflags, ltoModeFlags(ctx)...)
+
 	return cflags
 }
 
@@ -41,65 +184,239 @@ func deviceFlags(ctx android.BaseContext) []string {
 func hostFlags(ctx android.BaseContext) []string {
 	var cflags []string
 
-	if ctx.AConfig().IsEnvTrue("FORCE_BUILD_LLVM_DEBUG") {
+	if llvmSoongConfig(ctx).Bool("debug") {
 		cflags = append(cflags, "-O0", "-g")
 	}
 
-	profile_generate := ctx.AConfig().IsEnvTrue("FORCE_BUILD_LLVM_PROFILE_GENERATE")
-	profile_use := ctx.AConfig().Getenv("FORCE_BUILD_LLVM_PROFILE_USE")
+	return cflags
+}
+
+// ltoProperties is the `lto: { ... }` / `cfi: { ... }` property block
+// accepted by llvm_defaults, mirroring cc/lto.go so LLVM itself can be
+// bootstrapped with LTO/CFI the same way other Android C++ libraries can.
+type ltoProperties struct {
+	Lto struct {
+		// Build with ThinLTO (-flto=thin).
+		Thin *bool
+		// Build with full LTO (-flto).
+		Full *bool
+		// ThinLTO cache directory, passed as --thinlto-cache-dir (or
+		// -cache_path_lto on Darwin).
+		Cache_dir *string
+	}
+	Cfi struct {
+		// Build with Control Flow Integrity (-fsanitize=cfi).
+		Enabled *bool
+		// Recover from CFI failures instead of trapping, for diagnostic
+		// builds.
+		Diagnostic *bool
+	}
+}
+
+// ltoCflags computes the -flto*/-fsanitize=cfi compile flags shared by
+// every target. It errors out if both lto.thin and lto.full are set for
+// the same module.
+func ltoCflags(ctx android.LoadHookContext, p *ltoProperties) []string {
+	var flags []string
 
-	if (profile_generate && profile_use != "") {
-		ctx.ModuleErrorf("FORCE_BUILD_LLVM_PROFILE_GENERATE and FORCE_BUILD_LLVM_PROFILE_USE cannot be specified simultaneously")
+	thin := proptools.Bool(p.Lto.Thin)
+	full := proptools.Bool(p.Lto.Full)
+	if thin && full {
+		ctx.ModuleErrorf("lto.thin and lto.full cannot both be set for %s", ctx.ModuleName())
+		return flags
+	}
+	if thin {
+		flags = append(flags, "-flto=thin")
+	} else if full {
+		flags = append(flags, "-flto")
 	}
-	if (profile_generate) {
-		cflags = append(cflags, "-fprofile-instr-generate")
+
+	if proptools.Bool(p.Cfi.Enabled) {
+		flags = append(flags, "-fsanitize=cfi", "-fsanitize-cfi-cross-dso")
+		if proptools.Bool(p.Cfi.Diagnostic) {
+			flags = append(flags, "-fno-sanitize-trap=cfi", "-fsanitize-recover=cfi")
+		}
 	}
-	if (profile_use != "") {
-		cflags = append(cflags, "-fprofile-instr-use=" + profile_use)
+
+	return flags
+}
+
+// ltoLdflags appends the platform's ThinLTO cache-dir linker flag (if a
+// cache_dir was requested) to the shared LTO/CFI flags. darwin selects
+// the Mach-O ld64 spelling instead of the GNU one.
+func ltoLdflags(ctx android.LoadHookContext, p *ltoProperties, darwin bool) []string {
+	flags := ltoCflags(ctx, p)
+
+	dir := proptools.String(p.Lto.Cache_dir)
+	if dir == "" || !(proptools.Bool(p.Lto.Thin) || proptools.Bool(p.Lto.Full)) {
+		return flags
+	}
+
+	if darwin {
+		flags = append(flags, "-Wl,-cache_path_lto,"+dir)
+	} else {
+		flags = append(flags, "-Wl,--thinlto-cache-dir="+dir)
+	}
+
+	return flags
+}
+
+// pgoProperties is the `pgo: { ... }` property block accepted by
+// llvm_defaults and llvm_pgo. It lets a module opt into
+// instrumentation/use-phase PGO on a per-variant basis instead of the
+// build-wide FORCE_BUILD_LLVM_PROFILE_GENERATE/USE env vars this replaces.
+type pgoProperties struct {
+	Pgo struct {
+		// Whether this module may be built with -fprofile-generate when
+		// one of Benchmarks is selected via ANDROID_PGO_INSTRUMENT.
+		Instrumentation *bool
+		// Profile file for this module, resolved against the PGO profile
+		// directory (toolchain/pgo-profiles, or PGO_PROFILE_DIR).
+		Profile_file *string
+		// Benchmark names that can trigger instrumentation builds of this
+		// module via ANDROID_PGO_INSTRUMENT.
+		Benchmarks []string
+		// Whether to build this module against Profile_file with
+		// -fprofile-use.
+		Enable_profile_use *bool
+	}
+}
+
+func pgoProfileDirectory(ctx android.BaseContext) string {
+	if dir := ctx.AConfig().Getenv("PGO_PROFILE_DIR"); dir != "" {
+		return dir
+	}
+	return pgoProfileDir
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// pgoFlags computes the cflags/ldflags for the `pgo` property block and
+// enforces that instrumentation and use are not both requested for the
+// same module variant.
+func pgoFlags(ctx android.LoadHookContext, p *pgoProperties) []string {
+	var flags []string
+
+	benchmark := ctx.AConfig().Getenv("ANDROID_PGO_INSTRUMENT")
+	instrument := proptools.Bool(p.Pgo.Instrumentation) && benchmark != "" &&
+		containsString(p.Pgo.Benchmarks, benchmark)
+	use := proptools.Bool(p.Pgo.Enable_profile_use)
+
+	if instrument && use {
+		ctx.ModuleErrorf("pgo.instrumentation and pgo.enable_profile_use cannot both be set for %s", ctx.ModuleName())
+		return flags
+	}
+
+	if instrument {
+		flags = append(flags, "-fprofile-generate")
+	}
+
+	if use {
+		if p.Pgo.Profile_file == nil {
+			ctx.ModuleErrorf("pgo.enable_profile_use requires pgo.profile_file to be set")
+			return flags
+		}
+
+		profileFile, err := filepath.Abs(filepath.Join(pgoProfileDirectory(ctx), *p.Pgo.Profile_file))
+		if err != nil {
+			ctx.ModuleErrorf("could not resolve pgo.profile_file: %s", err)
+			return flags
+		}
+
+		if _, err := os.Stat(profileFile); err != nil {
+			ctx.ModuleErrorf("pgo.profile_file %q does not exist", profileFile)
+			return flags
+		}
+
+		ctx.AddNinjaFileDeps(profileFile)
+
+		flags = append(flags, "-fprofile-use="+profileFile)
 		// TODO (pirama): Investigate and enable these warnings
-		cflags = append(cflags, "-Wno-profile-instr-unprofiled")
-		cflags = append(cflags, "-Wno-profile-instr-out-of-date")
+		flags = append(flags, "-Wno-profile-instr-unprofiled")
+		flags = append(flags, "-Wno-profile-instr-out-of-date")
 	}
 
-	return cflags
+	return flags
 }
 
-func llvmDefaults(ctx android.LoadHookContext) {
+func llvmDefaults(ctx android.LoadHookContext, pgo *pgoProperties, lto *ltoProperties) {
 	type props struct {
 		Target struct {
 			Android struct {
 				Cflags  []string
+				Ldflags []string
 				Enabled *bool
 			}
 			Host struct {
 				Enabled *bool
 			}
 			Linux struct {
-				Cflags []string
+				Cflags  []string
+				Ldflags []string
 			}
 			Darwin struct {
-				Cflags []string
+				Cflags  []string
+				Ldflags []string
 			}
 		}
 		Cflags []string
 	}
 
+	pgoCflags := pgoFlags(ctx, pgo)
+
 	p := &props{}
 	p.Cflags = globalFlags(ctx)
-	p.Target.Android.Cflags = deviceFlags(ctx)
-	h := hostFlags(ctx)
+	p.Target.Android.Cflags = append(deviceFlags(ctx), ltoCflags(ctx, lto)...)
+	p.Target.Android.Ldflags = ltoLdflags(ctx, lto, false)
+	h := append(hostFlags(ctx), pgoCflags...)
+	h = append(h, ltoCflags(ctx, lto)...)
 	p.Target.Linux.Cflags = h
+	p.Target.Linux.Ldflags = append(pgoCflags, ltoLdflags(ctx, lto, false)...)
 	p.Target.Darwin.Cflags = h
+	p.Target.Darwin.Ldflags = append(pgoCflags, ltoLdflags(ctx, lto, true)...)
 
-	if ctx.AConfig().IsEnvTrue("DISABLE_LLVM_DEVICE_BUILDS") {
+	if llvmSoongConfig(ctx).Bool("disable_device_builds") {
 		p.Target.Android.Enabled = proptools.BoolPtr(false)
 	}
 
 	ctx.AppendProperties(p)
 }
 
+// llvmPgo lets a module pull in just the `pgo` property handling, for
+// modules that want PGO support without the rest of llvm_defaults.
+func llvmPgo(ctx android.LoadHookContext, pgo *pgoProperties) {
+	type props struct {
+		Target struct {
+			Linux struct {
+				Cflags  []string
+				Ldflags []string
+			}
+			Darwin struct {
+				Cflags  []string
+				Ldflags []string
+			}
+		}
+	}
+
+	p := &props{}
+	flags := pgoFlags(ctx, pgo)
+	p.Target.Linux.Cflags = flags
+	p.Target.Linux.Ldflags = flags
+	p.Target.Darwin.Cflags = flags
+	p.Target.Darwin.Ldflags = flags
+
+	ctx.AppendProperties(p)
+}
+
 func forceBuildLlvmComponents(ctx android.LoadHookContext) {
-	if !ctx.AConfig().IsEnvTrue("FORCE_BUILD_LLVM_COMPONENTS") {
+	if !llvmSoongConfig(ctx).Bool("build_llvm_components") {
 		type props struct {
 			Target struct {
 				Host struct {
@@ -113,14 +430,81 @@ func forceBuildLlvmComponents(ctx android.LoadHookContext) {
 	}
 }
 
+// elfCheckProperties is the extra property block accepted by
+// llvm_prebuilt_library/llvm_prebuilt_binary on top of whatever
+// cc.PrebuiltLibraryFactory/cc.PrebuiltBinaryFactory already register.
+type elfCheckProperties struct {
+	// Setting this to true fails the build with a ModuleErrorf. The
+	// prebuilt's exported symbols are not compared against the source
+	// llvm_defaults variant's.
+	Check_elf_files *bool
+}
+
+// llvmPreferPrebuilts reports whether LLVM_PREFER_PREBUILTS asks the
+// checked-in prebuilts/clang tree to be used instead of building LLVM
+// from source.
+func llvmPreferPrebuilts(ctx android.BaseContext) bool {
+	return ctx.AConfig().IsEnvTrue("LLVM_PREFER_PREBUILTS")
+}
+
+// llvmPrebuilt mirrors llvmDefaults' per-arch/per-OS enabled gating and,
+// when LLVM_PREFER_PREBUILTS is set, flips on Prefer so Soong's
+// prebuilt-selection mutator swaps this variant in for the source module
+// of the same name.
+func llvmPrebuilt(ctx android.LoadHookContext, elf *elfCheckProperties) {
+	type props struct {
+		Prefer *bool
+		Target struct {
+			Android struct {
+				Enabled *bool
+			}
+		}
+	}
+
+	p := &props{}
+	if llvmPreferPrebuilts(ctx) {
+		p.Prefer = proptools.BoolPtr(true)
+	}
+
+	if llvmSoongConfig(ctx).Bool("disable_device_builds") {
+		p.Target.Android.Enabled = proptools.BoolPtr(false)
+	}
+
+	if proptools.Bool(elf.Check_elf_files) {
+		// No symbol comparison is done here; fail loudly rather than
+		// silently skipping the check.
+		ctx.ModuleErrorf("check_elf_files is not implemented yet; ABI is not validated against the source variant")
+	}
+
+	ctx.AppendProperties(p)
+}
+
 func init() {
 	android.RegisterModuleType("llvm_defaults", llvmDefaultsFactory)
+	android.RegisterModuleType("llvm_pgo", llvmPgoFactory)
+	android.RegisterModuleType("llvm_release", llvmReleaseFactory)
+	android.RegisterModuleType("llvm_thin_lto", llvmThinLtoFactory)
+	android.RegisterModuleType("llvm_hwasan_host", llvmHwasanHostFactory)
+	android.RegisterModuleType("llvm_prebuilt_library", llvmPrebuiltLibraryFactory)
+	android.RegisterModuleType("llvm_prebuilt_binary", llvmPrebuiltBinaryFactory)
 	android.RegisterModuleType("force_build_llvm_components_defaults", forceBuildLlvmComponentsDefaultsFactory)
 }
 
 func llvmDefaultsFactory() (blueprint.Module, []interface{}) {
 	module, props := cc.DefaultsFactory()
-	android.AddLoadHook(module, llvmDefaults)
+	pgo := &pgoProperties{}
+	lto := &ltoProperties{}
+	props = append(props, pgo, lto)
+	android.AddLoadHook(module, func(ctx android.LoadHookContext) { llvmDefaults(ctx, pgo, lto) })
+
+	return module, props
+}
+
+func llvmPgoFactory() (blueprint.Module, []interface{}) {
+	module, props := cc.DefaultsFactory()
+	pgo := &pgoProperties{}
+	props = append(props, pgo)
+	android.AddLoadHook(module, func(ctx android.LoadHookContext) { llvmPgo(ctx, pgo) })
 
 	return module, props
 }
@@ -130,3 +514,19 @@ func forceBuildLlvmComponentsDefaultsFactory() (blueprint.Module, []interface{})
 	android.AddLoadHook(module, forceBuildLlvmComponents)
 	return module, props
 }
+
+func llvmPrebuiltLibraryFactory() android.Module {
+	module := cc.PrebuiltLibraryFactory()
+	elf := &elfCheckProperties{}
+	android.AddProperties(module, elf)
+	android.AddLoadHook(module, func(ctx android.LoadHookContext) { llvmPrebuilt(ctx, elf) })
+	return module
+}
+
+func llvmPrebuiltBinaryFactory() android.Module {
+	module := cc.PrebuiltBinaryFactory()
+	elf := &elfCheckProperties{}
+	android.AddProperties(module, elf)
+	android.AddLoadHook(module, func(ctx android.LoadHookContext) { llvmPrebuilt(ctx, elf) })
+	return module
+}